@@ -0,0 +1,556 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// externalMergeFanIn bounds how many spill files mergeSpillFiles opens at
+// once. collectSpillFiles can produce many more spill files than the
+// process's file descriptor limit allows to hold open simultaneously (that
+// is exactly the cardinality regime -external-merge targets), so
+// stageMergeSpillFiles folds them down to at most this many before the
+// final pass streams into the output.
+const externalMergeFanIn = 256
+
+// externalMergeResult is one worker's contribution in -external-merge mode:
+// the paths of the spill files it wrote, covering every record it saw.
+type externalMergeResult struct {
+	SpillPaths []string
+	Error      error
+}
+
+// externalMergeWorkItem mirrors multiFileWorkItem: either a (filename,
+// range) pair to be read with ReadAt (pread backend) or an already-mapped
+// byte slice (mmap backend).
+type externalMergeWorkItem struct {
+	filename string
+	r        Range
+	data     []byte
+}
+
+// taskExternalMerge is task's counterpart for -external-merge mode: it
+// opens filename itself and reads just range r, but instead of returning
+// one *stationTable for the whole range, it spills to disk every
+// spillThreshold stations so peak memory stays bounded regardless of range
+// size or station cardinality.
+func taskExternalMerge(filename string, r Range, spillThreshold int, resultChannel chan externalMergeResult) {
+	f, err := os.OpenFile(filename, os.O_RDONLY, 0)
+	if err != nil {
+		resultChannel <- externalMergeResult{Error: err}
+		return
+	}
+	defer f.Close()
+
+	buffer := make([]byte, r.End-r.Begin)
+	if _, err := f.ReadAt(buffer, r.Begin); err != nil {
+		resultChannel <- externalMergeResult{Error: err}
+		return
+	}
+
+	paths, err := aggregateBufferWithSpill(buffer, spillThreshold)
+	resultChannel <- externalMergeResult{SpillPaths: paths, Error: err}
+}
+
+// taskExternalMergeMmap is taskExternalMerge for the mmap backend: r is
+// simply a sub-slice of data, with no per-worker file open or read.
+func taskExternalMergeMmap(data []byte, r Range, spillThreshold int, resultChannel chan externalMergeResult) {
+	paths, err := aggregateBufferWithSpill(data[r.Begin:r.End], spillThreshold)
+	resultChannel <- externalMergeResult{SpillPaths: paths, Error: err}
+}
+
+// aggregateBufferWithSpill is aggregateBuffer's -external-merge counterpart:
+// the same hand-rolled hot loop, but once the in-progress table's station
+// count reaches spillThreshold it is sorted by name, spilled to a temp file
+// in the partial-aggregate format, and replaced with a fresh table. The
+// final (possibly under-threshold) table is always spilled too, so every
+// record a worker saw ends up in one of its returned spill files and the
+// merge step only ever has to deal with files.
+func aggregateBufferWithSpill(buffer []byte, spillThreshold int) ([]string, error) {
+	var spillPaths []string
+	table := newStationTable(512)
+
+	spill := func() error {
+		if table.count == 0 {
+			return nil
+		}
+		path, err := spillStationTable(table)
+		if err != nil {
+			return err
+		}
+		spillPaths = append(spillPaths, path)
+		table = newStationTable(512)
+		return nil
+	}
+
+	pos := 0
+	n := len(buffer)
+	for pos < n {
+		nameStart := pos
+		hash := fnvOffsetBasis64
+		for buffer[pos] != StationDelimeter {
+			hash = hashByte(hash, buffer[pos])
+			pos++
+		}
+		name := buffer[nameStart:pos]
+		pos++ // skip ';'
+
+		measurementStart := pos
+		for pos < n && buffer[pos] != MeasurementDelimeter {
+			pos++
+		}
+		measurement := parseTenths(buffer[measurementStart:pos])
+		if pos < n {
+			pos++ // skip '\n'
+		}
+
+		e := table.getOrInsert(name, hash)
+		e.Sum += int64(measurement)
+		e.Count++
+		if measurement < e.Min {
+			e.Min = measurement
+		}
+		if measurement > e.Max {
+			e.Max = measurement
+		}
+
+		if table.count >= spillThreshold {
+			if err := spill(); err != nil {
+				return spillPaths, err
+			}
+		}
+	}
+
+	if err := spill(); err != nil {
+		return spillPaths, err
+	}
+
+	return spillPaths, nil
+}
+
+// spillStationTable writes table's entries, sorted by station name, to a
+// new temp file in the partial-aggregate format and returns its path.
+// Sorting each spill file up front is what lets the later k-way merge just
+// walk every file forward in lockstep rather than re-sorting anything.
+func spillStationTable(table *stationTable) (string, error) {
+	stations := make([]string, 0, table.count)
+	readings := make(map[string]*Measurements, table.count)
+	table.each(func(e *stationEntry) {
+		station := string(e.name)
+		stations = append(stations, station)
+		readings[station] = &Measurements{Min: e.Min, Max: e.Max, Sum: e.Sum, Count: e.Count}
+	})
+	sort.Strings(stations)
+
+	f, err := os.CreateTemp("", "onebrc-spill-*.obrp")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := WritePartial(f, stations, readings); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// collectSpillFiles runs -external-merge's spilling phase across filenames:
+// the same single-file-vs-multi-file range splitting aggregateStations
+// uses, but with taskExternalMerge/taskExternalMergeMmap in place of
+// task/taskMmap so no worker ever holds more than spillThreshold stations
+// in memory at once.
+func collectSpillFiles(filenames []string, parallel int64, reader string, spillThreshold int) ([]string, error) {
+	if len(filenames) == 0 {
+		return nil, fmt.Errorf("No input files to aggregate")
+	}
+
+	var items []externalMergeWorkItem
+	var closers []func() error
+	defer func() {
+		for _, closeFn := range closers {
+			closeFn()
+		}
+	}()
+
+	if len(filenames) == 1 {
+		filename := filenames[0]
+
+		var ranges []Range
+		var data []byte
+		var err error
+		switch reader {
+		case ReaderPread:
+			ranges, err = determineRanges(filename, parallel, MeasurementDelimeter)
+		case ReaderMmap:
+			var closeMmap func() error
+			data, closeMmap, err = mmapFile(filename)
+			if err != nil {
+				return nil, err
+			}
+			closers = append(closers, closeMmap)
+			ranges, err = determineRangesForBytes(data, parallel, MeasurementDelimeter)
+		default:
+			return nil, fmt.Errorf("Unknown reader backend '%s' (expected '%s' or '%s')", reader, ReaderPread, ReaderMmap)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range ranges {
+			items = append(items, externalMergeWorkItem{filename: filename, r: r, data: data})
+		}
+	} else {
+		for _, filename := range filenames {
+			if reader == ReaderMmap {
+				data, closeFn, err := mmapFile(filename)
+				if err != nil {
+					return nil, err
+				}
+				closers = append(closers, closeFn)
+				items = append(items, externalMergeWorkItem{filename: filename, r: Range{Begin: 0, End: int64(len(data))}, data: data})
+				continue
+			}
+
+			if reader != ReaderPread {
+				return nil, fmt.Errorf("Unknown reader backend '%s' (expected '%s' or '%s')", reader, ReaderPread, ReaderMmap)
+			}
+
+			fi, err := os.Stat(filename)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, externalMergeWorkItem{filename: filename, r: Range{Begin: 0, End: fi.Size()}})
+		}
+	}
+
+	itemChannel := make(chan externalMergeWorkItem, len(items))
+	for _, item := range items {
+		itemChannel <- item
+	}
+	close(itemChannel)
+
+	resultChannel := make(chan externalMergeResult, parallel)
+
+	var wg sync.WaitGroup
+	for i := int64(0); i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range itemChannel {
+				if item.data != nil {
+					taskExternalMergeMmap(item.data, item.r, spillThreshold, resultChannel)
+				} else {
+					taskExternalMerge(item.filename, item.r, spillThreshold, resultChannel)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(resultChannel)
+	}()
+
+	var allPaths []string
+	for result := range resultChannel {
+		if result.Error != nil {
+			return allPaths, result.Error
+		}
+		allPaths = append(allPaths, result.SpillPaths...)
+	}
+
+	return allPaths, nil
+}
+
+// spillStream is one spill file's position in the k-way merge: the record
+// most recently read from it (name/m), or done once it's exhausted.
+type spillStream struct {
+	reader *PartialReader
+	file   *os.File
+	name   string
+	m      *Measurements
+	done   bool
+}
+
+func (s *spillStream) advance() error {
+	name, m, err := s.reader.Next()
+	if err == io.EOF {
+		s.done = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.name, s.m = name, m
+	return nil
+}
+
+// spillHeap is a container/heap min-heap of spillStreams ordered by the
+// current record's station name.
+type spillHeap []*spillStream
+
+func (h spillHeap) Len() int            { return len(h) }
+func (h spillHeap) Less(i, j int) bool  { return h[i].name < h[j].name }
+func (h spillHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *spillHeap) Push(x interface{}) { *h = append(*h, x.(*spillStream)) }
+func (h *spillHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	s := old[n-1]
+	*h = old[:n-1]
+	return s
+}
+
+// mergeSpillFiles opens every spill file and returns a next function that
+// performs a k-way merge over them, in station name order, combining
+// entries for the same station across files as it goes (so, like
+// aggregateMultipleFiles, the same station appearing in several spill
+// files is folded into a single record rather than emitted more than
+// once). close must be called once next has been drained (or on early
+// exit) to release the underlying files. Only one record per distinct
+// station name is ever held in memory at a time, plus one record per open
+// spill file, giving the promised O(workers * spillThreshold + k) peak
+// memory.
+func mergeSpillFiles(paths []string) (next func() (string, *Measurements, bool), closeAll func() error, err error) {
+	var openPaths []string
+	var files []*os.File
+
+	closeAll = func() error {
+		var firstErr error
+		for i, f := range files {
+			if err := f.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			if err := os.Remove(openPaths[i]); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	// abort closes whatever files opening paths has managed to open so far
+	// and, unlike closeAll, removes every path in paths regardless of
+	// whether it got that far - otherwise a failure partway through (e.g.
+	// hitting the process's open file limit) would leak every spill file
+	// after the one that failed.
+	abort := func(err error) (func() (string, *Measurements, bool), func() error, error) {
+		for _, f := range files {
+			f.Close()
+		}
+		removeSpillFiles(paths)
+		return nil, nil, err
+	}
+
+	h := make(spillHeap, 0, len(paths))
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return abort(err)
+		}
+		files = append(files, f)
+		openPaths = append(openPaths, path)
+
+		reader, err := NewPartialReader(f)
+		if err != nil {
+			return abort(err)
+		}
+
+		s := &spillStream{reader: reader, file: f}
+		if err := s.advance(); err != nil {
+			return abort(err)
+		}
+		if !s.done {
+			h = append(h, s)
+		}
+	}
+	heap.Init(&h)
+
+	advanceHead := func(s *spillStream) error {
+		if err := s.advance(); err != nil {
+			return err
+		}
+		if s.done {
+			heap.Pop(&h)
+		} else {
+			heap.Fix(&h, 0)
+		}
+		return nil
+	}
+
+	next = func() (string, *Measurements, bool) {
+		if h.Len() == 0 {
+			return "", nil, false
+		}
+
+		name := h[0].name
+		merged := h[0].m
+		if err := advanceHead(h[0]); err != nil {
+			return "", nil, false
+		}
+
+		for h.Len() > 0 && h[0].name == name {
+			merged = Merge(merged, h[0].m)
+			if err := advanceHead(h[0]); err != nil {
+				return "", nil, false
+			}
+		}
+
+		return name, merged, true
+	}
+
+	return next, closeAll, nil
+}
+
+// removeSpillFiles best-effort deletes every path in paths, ignoring
+// errors (a path may already be gone, e.g. folded into a later spill file
+// by stageMergeSpillFiles or removed by a previous cleanup attempt).
+func removeSpillFiles(paths []string) {
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// stageMergeSpillFiles folds paths down to at most fanIn spill files, so
+// the caller's final k-way merge never has to open more than that many at
+// once regardless of how many collectSpillFiles produced. It runs as many
+// rounds as needed, each merging fanIn paths at a time into one new spill
+// file via mergeSpillFilesToFile; mergeSpillFiles's closeAll removes each
+// round's inputs once they're folded into the next one, so only the
+// current round's unprocessed paths ever need explicit cleanup on error.
+func stageMergeSpillFiles(paths []string, fanIn int) ([]string, error) {
+	for len(paths) > fanIn {
+		var next []string
+		for len(paths) > 0 {
+			batchSize := fanIn
+			if batchSize > len(paths) {
+				batchSize = len(paths)
+			}
+			batch := paths[:batchSize]
+			paths = paths[batchSize:]
+
+			mergedPath, err := mergeSpillFilesToFile(batch)
+			if err != nil {
+				removeSpillFiles(next)
+				removeSpillFiles(paths)
+				return nil, err
+			}
+			next = append(next, mergedPath)
+		}
+		paths = next
+	}
+	return paths, nil
+}
+
+// mergeSpillFilesToFile k-way merges batch and writes the (already sorted)
+// result to a new spill file, for stageMergeSpillFiles's intermediate
+// rounds. batch's files are closed and removed by the time this returns,
+// success or failure, via mergeSpillFiles's closeAll.
+func mergeSpillFilesToFile(batch []string) (string, error) {
+	next, closeAll, err := mergeSpillFiles(batch)
+	if err != nil {
+		return "", err
+	}
+	defer closeAll()
+
+	f, err := os.CreateTemp("", "onebrc-spill-merged-*.obrp")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	writer, err := NewPartialWriter(f)
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	for {
+		station, m, ok := next()
+		if !ok {
+			break
+		}
+		if err := writer.WriteRecord(station, m); err != nil {
+			os.Remove(f.Name())
+			return "", err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// writeStreamingTextOutput is writeOutput for a merged stream rather than
+// a fully materialised map: it renders the same `{station=min/mean/max, ...}`
+// form directly from next, so -external-merge never has to hold more than
+// one station's result in memory to produce its output.
+func writeStreamingTextOutput(w io.Writer, next func() (string, *Measurements, bool)) error {
+	if _, err := io.WriteString(w, "{"); err != nil {
+		return err
+	}
+
+	first := true
+	for {
+		station, v, ok := next()
+		if !ok {
+			break
+		}
+		if !first {
+			if _, err := io.WriteString(w, ", "); err != nil {
+				return err
+			}
+		}
+		first = false
+
+		mean := float64(v.Sum) / 10.0 / float64(v.Count)
+		if _, err := fmt.Fprintf(w, "%s=%.1f/%.1f/%.1f", station, float64(v.Min)/10.0, mean, float64(v.Max)/10.0); err != nil {
+			return err
+		}
+	}
+
+	_, err := io.WriteString(w, "}\n")
+	return err
+}
+
+// runExternalMerge is the -external-merge entry point: it spills each
+// worker's partial aggregates to disk as their in-memory tables fill up
+// (see aggregateBufferWithSpill), folds the resulting spill files down to
+// externalMergeFanIn via stageMergeSpillFiles, then k-way merges what's
+// left straight into w, so peak memory is bounded by parallel *
+// spillThreshold stations plus one record per open spill file rather than
+// the full distinct-station count, and open file descriptors never exceed
+// externalMergeFanIn regardless of how many files collectSpillFiles wrote.
+func runExternalMerge(filenames []string, parallel int64, reader string, spillThreshold int, w io.Writer) error {
+	paths, err := collectSpillFiles(filenames, parallel, reader, spillThreshold)
+	if err != nil {
+		removeSpillFiles(paths)
+		return err
+	}
+
+	if len(paths) == 0 {
+		_, err := io.WriteString(w, "{}\n")
+		return err
+	}
+
+	paths, err = stageMergeSpillFiles(paths, externalMergeFanIn)
+	if err != nil {
+		return err
+	}
+
+	next, closeAll, err := mergeSpillFiles(paths)
+	if err != nil {
+		return err
+	}
+	defer closeAll()
+
+	return writeStreamingTextOutput(w, next)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// followPollInterval is how often runFollow checks the measurements file's
+// size for growth or truncation.
+const followPollInterval = 250 * time.Millisecond
+
+// followState carries everything that has to survive across polls: the
+// running aggregate, how far into the file we've consumed complete lines,
+// and any trailing partial line left over from the last poll.
+type followState struct {
+	table   *stationTable
+	offset  int64
+	partial []byte
+}
+
+// runFollow tails filename the way `tail -f` would, aggregating newly
+// appended measurements and emitting a snapshot in the usual
+// `{station=min/mean/max, ...}` format every snapshotInterval. It never
+// returns except on error.
+func runFollow(filename string, parallel int64, snapshotInterval time.Duration) error {
+	state := &followState{table: newStationTable(512)}
+	lastSnapshot := time.Now()
+
+	for {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		size := fi.Size()
+
+		if size < state.offset {
+			// The file shrank out from under us (truncated or replaced);
+			// start aggregating from scratch rather than report stale data.
+			state.table = newStationTable(512)
+			state.offset = 0
+			state.partial = nil
+		}
+
+		if size > state.offset {
+			if err := state.consume(filename, size, parallel); err != nil {
+				return err
+			}
+		}
+
+		if time.Since(lastSnapshot) >= snapshotInterval {
+			output, err := state.snapshot()
+			if err != nil {
+				return err
+			}
+			fmt.Println(output)
+			lastSnapshot = time.Now()
+		}
+
+		time.Sleep(followPollInterval)
+	}
+}
+
+// consume reads the bytes appended to filename since s.offset, carries any
+// trailing partial line forward to the next call, and aggregates the
+// complete lines across parallel workers into s.table.
+func (s *followState) consume(filename string, newSize int64, parallel int64) error {
+	f, err := os.OpenFile(filename, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	appended := newSize - s.offset
+	chunk := make([]byte, int64(len(s.partial))+appended)
+	copy(chunk, s.partial)
+	if _, err := f.ReadAt(chunk[len(s.partial):], s.offset); err != nil {
+		return err
+	}
+	s.offset = newSize
+
+	lastNewline := bytes.LastIndexByte(chunk, MeasurementDelimeter)
+	if lastNewline == -1 {
+		// No complete line in this poll yet; keep accumulating.
+		s.partial = chunk
+		return nil
+	}
+
+	complete := chunk[:lastNewline+1]
+	s.partial = append([]byte(nil), chunk[lastNewline+1:]...)
+
+	// determineRangesForBytes's backward delimiter scan assumes there are at
+	// least n complete lines to find range boundaries between; a poll can
+	// append far fewer lines than parallel, so clamp to what's actually
+	// available or it walks off the front of complete.
+	lineCount := int64(bytes.Count(complete, []byte{MeasurementDelimeter}))
+	rangeCount := parallel
+	if lineCount < rangeCount {
+		rangeCount = lineCount
+	}
+	if rangeCount < 1 {
+		rangeCount = 1
+	}
+
+	ranges, err := determineRangesForBytes(complete, rangeCount, MeasurementDelimeter)
+	if err != nil {
+		return err
+	}
+
+	resultChannel := make(chan AggregationResult, len(ranges))
+	var wg sync.WaitGroup
+	for _, r := range ranges {
+		r := r
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			taskMmap(complete, r, resultChannel)
+		}()
+	}
+
+	for range ranges {
+		result := <-resultChannel
+		if result.Error != nil {
+			return result.Error
+		}
+		mergeStationTables(s.table, result.Table)
+	}
+	wg.Wait()
+	close(resultChannel)
+
+	return nil
+}
+
+// snapshot renders the current aggregate in the usual output format.
+func (s *followState) snapshot() (string, error) {
+	readings := make(map[string]*Measurements)
+	s.table.each(func(e *stationEntry) {
+		readings[string(e.name)] = &Measurements{
+			Min:   e.Min,
+			Max:   e.Max,
+			Sum:   e.Sum,
+			Count: e.Count,
+		}
+	})
+
+	var stations []string
+	for k := range readings {
+		stations = append(stations, k)
+	}
+	sort.Strings(stations)
+
+	return writeOutput(&stations, &readings)
+}
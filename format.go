@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Output format names accepted by the -format flag.
+const (
+	FormatText    = "text"
+	FormatJSON    = "json"
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+)
+
+// OutputFormatter renders a final aggregation result to w. stations gives
+// the station names in the order they should be emitted (sorted
+// alphabetically, as the rest of the tool already assumes).
+type OutputFormatter interface {
+	Write(w io.Writer, stations []string, readings map[string]*Measurements) error
+}
+
+// newOutputFormatter resolves the -format flag value to an OutputFormatter.
+func newOutputFormatter(format string) (OutputFormatter, error) {
+	switch format {
+	case FormatText:
+		return textOutputFormatter{}, nil
+	case FormatJSON:
+		return jsonOutputFormatter{}, nil
+	case FormatCSV:
+		return csvOutputFormatter{}, nil
+	case FormatParquet:
+		return parquetOutputFormatter{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown output format '%s' (expected '%s', '%s', '%s' or '%s')", format, FormatText, FormatJSON, FormatCSV, FormatParquet)
+	}
+}
+
+// textOutputFormatter is the original 1BRC `{station=min/mean/max, ...}` form.
+type textOutputFormatter struct{}
+
+func (textOutputFormatter) Write(w io.Writer, stations []string, readings map[string]*Measurements) error {
+	output, err := writeOutput(&stations, &readings)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, output)
+	return err
+}
+
+type jsonStation struct {
+	Min   float64 `json:"min"`
+	Mean  float64 `json:"mean"`
+	Max   float64 `json:"max"`
+	Count int64   `json:"count"`
+}
+
+// jsonOutputFormatter emits a single object keyed by station name.
+type jsonOutputFormatter struct{}
+
+func (jsonOutputFormatter) Write(w io.Writer, stations []string, readings map[string]*Measurements) error {
+	out := make(map[string]jsonStation, len(stations))
+	for _, station := range stations {
+		v := readings[station]
+		out[station] = jsonStation{
+			Min:   float64(v.Min) / 10.0,
+			Mean:  float64(v.Sum) / 10.0 / float64(v.Count),
+			Max:   float64(v.Max) / 10.0,
+			Count: v.Count,
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(out)
+}
+
+// csvOutputFormatter emits station,min,mean,max,count rows.
+type csvOutputFormatter struct{}
+
+func (csvOutputFormatter) Write(w io.Writer, stations []string, readings map[string]*Measurements) error {
+	writer := csv.NewWriter(w)
+
+	if err := writer.Write([]string{"station", "min", "mean", "max", "count"}); err != nil {
+		return err
+	}
+
+	for _, station := range stations {
+		v := readings[station]
+		mean := float64(v.Sum) / 10.0 / float64(v.Count)
+		row := []string{
+			station,
+			fmt.Sprintf("%.1f", float64(v.Min)/10.0),
+			fmt.Sprintf("%.1f", mean),
+			fmt.Sprintf("%.1f", float64(v.Max)/10.0),
+			fmt.Sprintf("%d", v.Count),
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// parquetOutputFormatter emits a columnar Parquet file; see parquet.go.
+type parquetOutputFormatter struct{}
+
+func (parquetOutputFormatter) Write(w io.Writer, stations []string, readings map[string]*Measurements) error {
+	return writeParquet(w, stations, readings)
+}
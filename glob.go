@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// expandInputs resolves glob patterns (and plain paths) into a
+// deduplicated, deterministically ordered list of regular files.
+// Directories are skipped with a warning unless recursive is set, in
+// which case they're walked for regular files; unreadable paths are
+// likewise warned about and skipped rather than failing the whole run.
+func expandInputs(patterns []string, recursive bool) ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+
+	addFile := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			files = append(files, path)
+		}
+	}
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			fmt.Fprintf(os.Stderr, "Warning: pattern '%s' matched no files\n", pattern)
+			continue
+		}
+
+		for _, match := range matches {
+			fi, err := os.Stat(match)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: skipping unreadable path '%s': %v\n", match, err)
+				continue
+			}
+
+			if !fi.IsDir() {
+				addFile(match)
+				continue
+			}
+
+			if !recursive {
+				fmt.Fprintf(os.Stderr, "Warning: skipping directory '%s' (use -recursive to include its contents)\n", match)
+				continue
+			}
+
+			err = filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: skipping unreadable path '%s': %v\n", path, err)
+					return nil
+				}
+				if info.IsDir() {
+					return nil
+				}
+				addFile(path)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return files, nil
+}
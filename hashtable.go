@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"math"
+)
+
+// FNV-1a 64-bit constants, used to hash station names inline while scanning
+// for the ';' delimiter so no separate pass over the name is required.
+const (
+	fnvOffsetBasis64 uint64 = 14695981039346656037
+	fnvPrime64       uint64 = 1099511628211
+)
+
+// stationTableMaxLoadFactor is the load factor above which stationTable
+// doubles its slot array. Kept well under 1 so linear probes stay short.
+const stationTableMaxLoadFactor = 0.75
+
+// stationEntry holds the running aggregate for a single station, in tenths
+// of a degree. name points into the owning stationTable's arena rather than
+// being a separately allocated string, so a new station costs one arena
+// append instead of one allocation.
+type stationEntry struct {
+	name  []byte
+	hash  uint64
+	Min   int32
+	Max   int32
+	Sum   int64
+	Count int64
+}
+
+// stationTable is an open-addressed (linear probing), power-of-two sized
+// hash table keyed by raw station name bytes. It is built per-worker so
+// each goroutine can run without locking, and is not safe for concurrent
+// use.
+type stationTable struct {
+	slots         []*stationEntry
+	mask          uint64
+	count         int
+	arena         []byte
+	growThreshold int // count above which the next insert triggers grow
+}
+
+// newStationTable returns a stationTable with room for at least
+// capacityHint entries before its first resize.
+func newStationTable(capacityHint int) *stationTable {
+	capacity := nextPowerOfTwo(capacityHint)
+	return &stationTable{
+		slots:         make([]*stationEntry, capacity),
+		mask:          uint64(capacity - 1),
+		growThreshold: growThresholdFor(capacity),
+	}
+}
+
+// growThresholdFor returns the count above which a table with the given
+// slot capacity should grow, derived from stationTableMaxLoadFactor once
+// per resize so getOrInsert's hot path only ever does an integer compare.
+func growThresholdFor(capacity int) int {
+	return int(float64(capacity) * stationTableMaxLoadFactor)
+}
+
+// getOrInsert returns the entry for name, computing its hash from the
+// caller-supplied FNV-1a hash (so the hash computed while scanning for ';'
+// is reused rather than recomputed here). A freshly inserted entry starts
+// with Min/Max set to sentinel extremes so the caller can unconditionally
+// apply min/max against the first reading.
+func (t *stationTable) getOrInsert(name []byte, hash uint64) *stationEntry {
+	if t.count+1 > t.growThreshold {
+		t.grow()
+	}
+
+	idx := hash & t.mask
+	for {
+		e := t.slots[idx]
+		if e == nil {
+			e = &stationEntry{
+				name: t.intern(name),
+				hash: hash,
+				Min:  math.MaxInt32,
+				Max:  math.MinInt32,
+			}
+			t.slots[idx] = e
+			t.count++
+			return e
+		}
+		if e.hash == hash && bytes.Equal(e.name, name) {
+			return e
+		}
+		idx = (idx + 1) & t.mask
+	}
+}
+
+// grow doubles the slot array and reinserts every entry by its stored hash.
+func (t *stationTable) grow() {
+	newSlots := make([]*stationEntry, len(t.slots)*2)
+	newMask := uint64(len(newSlots) - 1)
+
+	for _, e := range t.slots {
+		if e == nil {
+			continue
+		}
+		idx := e.hash & newMask
+		for newSlots[idx] != nil {
+			idx = (idx + 1) & newMask
+		}
+		newSlots[idx] = e
+	}
+
+	t.slots = newSlots
+	t.mask = newMask
+	t.growThreshold = growThresholdFor(len(newSlots))
+}
+
+// intern copies name into the table's arena and returns the copy, so
+// entries don't keep the (much larger) input buffer alive and don't each
+// need their own allocation.
+func (t *stationTable) intern(name []byte) []byte {
+	start := len(t.arena)
+	t.arena = append(t.arena, name...)
+	return t.arena[start : start+len(name)]
+}
+
+// each calls fn once for every occupied entry, in slot order (i.e.
+// unordered with respect to station name).
+func (t *stationTable) each(fn func(e *stationEntry)) {
+	for _, e := range t.slots {
+		if e != nil {
+			fn(e)
+		}
+	}
+}
+
+// mergeStationTables folds every entry of src into dst, returning dst.
+func mergeStationTables(dst, src *stationTable) *stationTable {
+	src.each(func(e *stationEntry) {
+		d := dst.getOrInsert(e.name, e.hash)
+		d.Sum += e.Sum
+		d.Count += e.Count
+		if e.Min < d.Min {
+			d.Min = e.Min
+		}
+		if e.Max > d.Max {
+			d.Max = e.Max
+		}
+	})
+	return dst
+}
+
+func nextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+// hashByte folds a single byte into an in-progress FNV-1a hash.
+func hashByte(h uint64, b byte) uint64 {
+	return (h ^ uint64(b)) * fnvPrime64
+}
+
+// parseTenths parses a 1BRC measurement (a signed decimal with exactly one
+// fractional digit, e.g. "-3.2" or "99.9") into tenths of a degree,
+// avoiding strconv.ParseFloat's general-purpose parsing entirely.
+func parseTenths(b []byte) int32 {
+	neg := false
+	i := 0
+	if b[0] == '-' {
+		neg = true
+		i = 1
+	}
+
+	v := int32(0)
+	for ; i < len(b); i++ {
+		c := b[i]
+		if c == '.' {
+			continue
+		}
+		v = v*10 + int32(c-'0')
+	}
+
+	if neg {
+		v = -v
+	}
+	return v
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"flag"
 	"fmt"
@@ -10,19 +9,20 @@ import (
 	"os"
 	"runtime/pprof"
 	"sort"
-	"strconv"
 	"sync"
-	"unsafe"
+	"time"
 )
 
 var StationDelimeter = []byte(";")[0]
 var MeasurementDelimeter = []byte("\n")[0]
 
+// Measurements holds the aggregate for a station in tenths of a degree.
+// Values are only converted to float at output time.
 type Measurements struct {
-	Min   float32
-	Max   float32
-	Sum   float32
-	Count int
+	Min   int32
+	Max   int32
+	Sum   int64
+	Count int64
 }
 
 type Range struct {
@@ -31,14 +31,13 @@ type Range struct {
 }
 
 type AggregationResult struct {
-	Measurements map[string]*Measurements
-	Error        error
+	Table *stationTable
+	Error error
 }
 
+// determineRanges splits filename into n ranges of roughly equal size, each
+// ending just after a delim byte so no range splits a line in two.
 func determineRanges(filename string, n int64, delim byte) ([]Range, error) {
-	var ranges []Range
-	var b = make([]byte, 1)
-
 	f, err := os.OpenFile(filename, os.O_RDONLY, 0)
 	if err != nil {
 		return []Range{}, err
@@ -49,6 +48,32 @@ func determineRanges(filename string, n int64, delim byte) ([]Range, error) {
 	}
 	defer f.Close()
 
+	var b = make([]byte, 1)
+	at := func(i int64) byte {
+		f.Seek(i, 0)
+		f.Read(b)
+		return b[0]
+	}
+
+	return determineRangesFromAccessor(length, n, delim, at)
+}
+
+// determineRangesForBytes is determineRanges for data already resident in
+// memory (e.g. an mmap'd file), so no seeks/reads are needed to probe range
+// boundaries.
+func determineRangesForBytes(data []byte, n int64, delim byte) ([]Range, error) {
+	at := func(i int64) byte {
+		return data[i]
+	}
+	return determineRangesFromAccessor(int64(len(data)), n, delim, at)
+}
+
+// determineRangesFromAccessor holds the range-splitting logic shared by
+// determineRanges and determineRangesForBytes, reading bytes at arbitrary
+// offsets via at rather than assuming a particular backing store.
+func determineRangesFromAccessor(length int64, n int64, delim byte, at func(int64) byte) ([]Range, error) {
+	var ranges []Range
+
 	if n == 1 {
 		r := Range{Begin: 0, End: length}
 		ranges = append(ranges, r)
@@ -67,9 +92,7 @@ func determineRanges(filename string, n int64, delim byte) ([]Range, error) {
 
 	// Adjust end
 	for {
-		f.Seek(ranges[0].End, 0)
-		f.Read(b)
-		if b[0] == delim {
+		if at(ranges[0].End) == delim {
 			// We want to be one past the delimiter for an exclusive range on the right
 			ranges[0].End++
 			break
@@ -92,9 +115,7 @@ func determineRanges(filename string, n int64, delim byte) ([]Range, error) {
 		middle := Range{Begin: begin, End: end}
 
 		for {
-			f.Seek(middle.End, 0)
-			f.Read(b)
-			if b[0] == delim {
+			if at(middle.End) == delim {
 				// We want to be one past the delimiter for an exclusive range on the right
 				middle.End++
 				break
@@ -138,11 +159,11 @@ func writeOutput(stations *[]string, readings *map[string]*Measurements) (string
 	buffer.WriteString("{")
 	for i, station := range *stations {
 		v, ok := (*readings)[station]
-		mean := v.Sum / float32(v.Count)
 		if !ok {
 			return "", fmt.Errorf("Missing entry for key '%s' (expected this to exist as we've seen this key before)", station)
 		}
-		buffer.WriteString(fmt.Sprintf("%s=%.1f/%.1f/%.1f", station, v.Min, mean, v.Max))
+		mean := float64(v.Sum) / 10.0 / float64(v.Count)
+		buffer.WriteString(fmt.Sprintf("%s=%.1f/%.1f/%.1f", station, float64(v.Min)/10.0, mean, float64(v.Max)/10.0))
 		if i < numStations-1 {
 			buffer.WriteString(", ")
 		}
@@ -153,69 +174,119 @@ func writeOutput(stations *[]string, readings *map[string]*Measurements) (string
 	return output, nil
 }
 
-func task(filename string, r Range, aggregationResultChannel chan AggregationResult) {
-	readings := make(map[string]*Measurements)
+// aggregateBuffer runs the hand-rolled hot loop over buffer, hashing station
+// names (FNV-1a) in the same pass that finds ';' and parsing temperatures
+// directly into tenths-of-a-degree ints, since the 1BRC input format
+// guarantees a signed decimal with exactly one fractional digit in
+// [-99.9, 99.9].
+func aggregateBuffer(buffer []byte) *stationTable {
+	table := newStationTable(512)
+
+	pos := 0
+	n := len(buffer)
+	for pos < n {
+		nameStart := pos
+		hash := fnvOffsetBasis64
+		for buffer[pos] != StationDelimeter {
+			hash = hashByte(hash, buffer[pos])
+			pos++
+		}
+		name := buffer[nameStart:pos]
+		pos++ // skip ';'
 
+		measurementStart := pos
+		for pos < n && buffer[pos] != MeasurementDelimeter {
+			pos++
+		}
+		measurement := parseTenths(buffer[measurementStart:pos])
+		if pos < n {
+			pos++ // skip '\n'
+		}
+
+		e := table.getOrInsert(name, hash)
+		e.Sum += int64(measurement)
+		e.Count++
+		if measurement < e.Min {
+			e.Min = measurement
+		}
+		if measurement > e.Max {
+			e.Max = measurement
+		}
+	}
+
+	return table
+}
+
+// task aggregates the measurements in r by opening filename itself and
+// reading just that range, so peak memory is bounded by the range size
+// rather than the whole file.
+func task(filename string, r Range, aggregationResultChannel chan AggregationResult) {
 	f, err := os.OpenFile(filename, os.O_RDONLY, 0)
 	if err != nil {
-		result := AggregationResult{Error: err}
-		aggregationResultChannel <- result
+		aggregationResultChannel <- AggregationResult{Error: err}
+		return
 	}
 	defer f.Close()
 
-	sectionReader := io.NewSectionReader(f, r.Begin, r.End-r.Begin)
-	scanner := bufio.NewScanner(sectionReader)
-
-	for scanner.Scan() {
-		buffer := scanner.Bytes()
-
-		stationDelimeterPos := 0
-		for {
-			if buffer[stationDelimeterPos] == StationDelimeter {
-				break
-			}
-			stationDelimeterPos++
-		}
+	buffer := make([]byte, r.End-r.Begin)
+	if _, err := f.ReadAt(buffer, r.Begin); err != nil {
+		aggregationResultChannel <- AggregationResult{Error: err}
+		return
+	}
 
-		station := string(buffer[:stationDelimeterPos])
+	aggregationResultChannel <- AggregationResult{Table: aggregateBuffer(buffer)}
+}
 
-		measurementStr := unsafe.String(unsafe.SliceData(buffer[stationDelimeterPos+1:]), len(buffer)-stationDelimeterPos-1)
-		measurement, err := strconv.ParseFloat(measurementStr, 32)
-		if err != nil {
-			result := AggregationResult{Error: err}
-			aggregationResultChannel <- result
-		}
+// taskMmap aggregates the measurements in r directly out of data, which is
+// expected to be the whole input file mapped into memory by run(). There is
+// no per-worker file open or read: r is simply a sub-slice of data.
+func taskMmap(data []byte, r Range, aggregationResultChannel chan AggregationResult) {
+	aggregationResultChannel <- AggregationResult{Table: aggregateBuffer(data[r.Begin:r.End])}
+}
 
-		m32 := float32(measurement)
-
-		v, ok := readings[station]
-		if ok {
-			v.Sum = v.Sum + m32
-			v.Min = min(v.Min, m32)
-			v.Max = max(v.Max, m32)
-			v.Count = v.Count + 1
-		} else {
-			new := Measurements{
-				Sum:   m32,
-				Min:   m32,
-				Max:   m32,
-				Count: 1,
-			}
-			readings[station] = &new
-		}
+// Reader backend names accepted by the -reader flag.
+const (
+	ReaderPread = "pread"
+	ReaderMmap    = "mmap"
+)
 
+// aggregateStations computes the sorted station list and per-station
+// aggregates across filenames (as if they were concatenated), splitting
+// the work across parallel workers using the given reader backend.
+func aggregateStations(filenames []string, parallel int64, reader string) ([]string, map[string]*Measurements, error) {
+	if len(filenames) == 0 {
+		return nil, nil, fmt.Errorf("No input files to aggregate")
 	}
-
-	result := AggregationResult{
-		Measurements: readings,
+	if len(filenames) == 1 {
+		return aggregateSingleFile(filenames[0], parallel, reader)
 	}
-	aggregationResultChannel <- result
+	return aggregateMultipleFiles(filenames, parallel, reader)
 }
 
-func run(filename string, parallel int64) (string, error) {
-	ranges, err := determineRanges(filename, parallel, MeasurementDelimeter)
+// aggregateSingleFile is the single-file case of aggregateStations: the
+// file is split into parallel ranges so a lone (likely huge) input is
+// still aggregated with full worker-pool parallelism.
+func aggregateSingleFile(filename string, parallel int64, reader string) ([]string, map[string]*Measurements, error) {
+	var ranges []Range
+	var data []byte
+	var err error
+
+	switch reader {
+	case ReaderPread:
+		ranges, err = determineRanges(filename, parallel, MeasurementDelimeter)
+	case ReaderMmap:
+		var closeMmap func() error
+		data, closeMmap, err = mmapFile(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer closeMmap()
+		ranges, err = determineRangesForBytes(data, parallel, MeasurementDelimeter)
+	default:
+		return nil, nil, fmt.Errorf("Unknown reader backend '%s' (expected '%s' or '%s')", reader, ReaderPread, ReaderMmap)
+	}
 	if err != nil {
-		return "", err
+		return nil, nil, err
 	}
 	// printRanges(filename, ranges)
 
@@ -228,7 +299,11 @@ func run(filename string, parallel int64) (string, error) {
 		i := i
 		go func() {
 			defer wg.Done()
-			task(filename, ranges[i], aggregatorChannel)
+			if reader == ReaderMmap {
+				taskMmap(data, ranges[i], aggregatorChannel)
+			} else {
+				task(filename, ranges[i], aggregatorChannel)
+			}
 		}()
 	}
 
@@ -237,25 +312,17 @@ func run(filename string, parallel int64) (string, error) {
 	for i := int64(0); i < parallel; i++ {
 		subreadings := <-aggregatorChannel
 		if subreadings.Error != nil {
-			return "", subreadings.Error
+			return nil, nil, subreadings.Error
 		}
-		for station, measurements := range subreadings.Measurements {
-			v, ok := readings[station]
-			if ok {
-				v.Sum = v.Sum + measurements.Sum
-				v.Min = min(v.Min, measurements.Min)
-				v.Max = max(v.Max, measurements.Max)
-				v.Count = v.Count + measurements.Count
+		subreadings.Table.each(func(e *stationEntry) {
+			station := string(e.name)
+			m := &Measurements{Min: e.Min, Max: e.Max, Sum: e.Sum, Count: e.Count}
+			if v, ok := readings[station]; ok {
+				readings[station] = Merge(v, m)
 			} else {
-				new := Measurements{
-					Sum:   measurements.Sum,
-					Min:   measurements.Min,
-					Max:   measurements.Max,
-					Count: measurements.Count,
-				}
-				readings[station] = &new
+				readings[station] = m
 			}
-		}
+		})
 	}
 
 	wg.Wait()
@@ -268,22 +335,160 @@ func run(filename string, parallel int64) (string, error) {
 
 	sort.Strings(stations)
 
-	output, err := writeOutput(&stations, &readings)
+	return stations, readings, nil
+}
+
+// multiFileWorkItem is one file's worth of work for aggregateMultipleFiles:
+// either the whole file by name (pread backend) or an already-mapped
+// byte slice (mmap backend).
+type multiFileWorkItem struct {
+	filename string
+	r        Range
+	data     []byte
+}
+
+// aggregateMultipleFiles aggregates filenames as if they were
+// concatenated. Each file is a single unit of work (it is not further
+// split into sub-ranges), and a fixed pool of parallel workers pulls work
+// items from a shared queue, so the degree of parallelism doesn't grow
+// with the number of matched files.
+func aggregateMultipleFiles(filenames []string, parallel int64, reader string) ([]string, map[string]*Measurements, error) {
+	var items []multiFileWorkItem
+	var closers []func() error
+	defer func() {
+		for _, closeFn := range closers {
+			closeFn()
+		}
+	}()
+
+	for _, filename := range filenames {
+		if reader == ReaderMmap {
+			data, closeFn, err := mmapFile(filename)
+			if err != nil {
+				return nil, nil, err
+			}
+			closers = append(closers, closeFn)
+			items = append(items, multiFileWorkItem{filename: filename, r: Range{Begin: 0, End: int64(len(data))}, data: data})
+			continue
+		}
+
+		if reader != ReaderPread {
+			return nil, nil, fmt.Errorf("Unknown reader backend '%s' (expected '%s' or '%s')", reader, ReaderPread, ReaderMmap)
+		}
+
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		items = append(items, multiFileWorkItem{filename: filename, r: Range{Begin: 0, End: fi.Size()}})
+	}
+
+	itemChannel := make(chan multiFileWorkItem, len(items))
+	for _, item := range items {
+		itemChannel <- item
+	}
+	close(itemChannel)
+
+	aggregatorChannel := make(chan AggregationResult, parallel)
+
+	var wg sync.WaitGroup
+	for i := int64(0); i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range itemChannel {
+				if item.data != nil {
+					taskMmap(item.data, item.r, aggregatorChannel)
+				} else {
+					task(item.filename, item.r, aggregatorChannel)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(aggregatorChannel)
+	}()
+
+	readings := make(map[string]*Measurements)
+	for result := range aggregatorChannel {
+		if result.Error != nil {
+			return nil, nil, result.Error
+		}
+		result.Table.each(func(e *stationEntry) {
+			station := string(e.name)
+			m := &Measurements{Min: e.Min, Max: e.Max, Sum: e.Sum, Count: e.Count}
+			if v, ok := readings[station]; ok {
+				readings[station] = Merge(v, m)
+			} else {
+				readings[station] = m
+			}
+		})
+	}
+
+	var stations []string
+	for k := range readings {
+		stations = append(stations, k)
+	}
+
+	sort.Strings(stations)
+
+	return stations, readings, nil
+}
+
+func run(filenames []string, parallel int64, reader string) (string, error) {
+	stations, readings, err := aggregateStations(filenames, parallel, reader)
 	if err != nil {
 		return "", err
 	}
 
-	return output, nil
+	return writeOutput(&stations, &readings)
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "aggregate":
+			if err := runAggregateCommand(os.Args[2:]); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			return
+		case "merge":
+			if err := runMergeCommand(os.Args[2:]); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	parallel := flag.Int64("parallel", 1, "")
 	profileCPUFile := flag.String("profile-cpu", "", "Profile CPU and write to `file`")
+	reader := flag.String("reader", ReaderPread, "Input backend to use: `mmap` or `pread`")
+	follow := flag.Bool("follow", false, "Keep reading appended data from the measurements file, emitting periodic snapshots instead of a single final result")
+	snapshotInterval := flag.Duration("snapshot-interval", 10*time.Second, "How often to emit a snapshot in -follow mode")
+	format := flag.String("format", FormatText, "Output format: `text`, `json`, `csv` or `parquet`")
+	outputPath := flag.String("o", "", "Write output to `file` instead of stdout")
+	recursive := flag.Bool("recursive", false, "Walk directories matched by an input pattern and include the files found")
+	externalMerge := flag.Bool("external-merge", false, "Spill each worker's partial aggregates to disk past -spill-threshold stations and k-way merge them, for inputs with more distinct stations than fit in memory")
+	spillThreshold := flag.Int("spill-threshold", 1_000_000, "Station count at which a worker spills its in-memory table to disk in -external-merge mode")
 
 	flag.Parse()
 
-	if flag.NArg() != 1 {
-		fmt.Printf("Usage: %s <MEASUREMENTS>\n", os.Args[0])
+	if flag.NArg() < 1 {
+		fmt.Printf("Usage: %s <MEASUREMENTS...>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	if *follow && flag.NArg() != 1 {
+		fmt.Println("-follow only supports a single input file")
+		os.Exit(1)
+	}
+
+	if *externalMerge && *format != FormatText {
+		fmt.Printf("-external-merge only supports -format=%s (its k-way merge streams text output directly; %s still needs a fully materialised result)\n", FormatText, *format)
 		os.Exit(1)
 	}
 
@@ -299,12 +504,144 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	measurementsFile := flag.Arg(0)
-	output, err := run(measurementsFile, *parallel)
+	if *follow {
+		if err := runFollow(flag.Arg(0), *parallel, *snapshotInterval); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	measurementsFiles, err := expandInputs(flag.Args(), *recursive)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(measurementsFiles) == 0 {
+		fmt.Println("No input files matched")
+		os.Exit(1)
+	}
+
+	out := io.Writer(os.Stdout)
+	if *outputPath != "" {
+		f, err := os.Create(*outputPath)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if *externalMerge {
+		if err := runExternalMerge(measurementsFiles, *parallel, *reader, *spillThreshold, out); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	formatter, err := newOutputFormatter(*format)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
+	stations, readings, err := aggregateStations(measurementsFiles, *parallel, *reader)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err := formatter.Write(out, stations, readings); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// runAggregateCommand implements `aggregate --out partial.bin <MEASUREMENTS>`,
+// writing the aggregation result in the partial-aggregate format instead of
+// printing it, so it can be combined later with `merge`.
+func runAggregateCommand(args []string) error {
+	fs := flag.NewFlagSet("aggregate", flag.ExitOnError)
+	parallel := fs.Int64("parallel", 1, "")
+	reader := fs.String("reader", ReaderPread, "Input backend to use: `mmap` or `pread`")
+	out := fs.String("out", "", "Path to write the partial aggregate to (required)")
+	recursive := fs.Bool("recursive", false, "Walk directories matched by an input pattern and include the files found")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		return fmt.Errorf("Usage: %s aggregate --out <PARTIAL> <MEASUREMENTS...>", os.Args[0])
+	}
+	if *out == "" {
+		return fmt.Errorf("--out is required")
+	}
+
+	filenames, err := expandInputs(fs.Args(), *recursive)
+	if err != nil {
+		return err
+	}
+	if len(filenames) == 0 {
+		return fmt.Errorf("No input files matched")
+	}
+
+	stations, readings, err := aggregateStations(filenames, *parallel, *reader)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return WritePartial(f, stations, readings)
+}
+
+// runMergeCommand implements `merge <partial1.bin> <partial2.bin> ...`,
+// combining partial-aggregate files produced by `aggregate --out` into the
+// usual 1BRC output.
+func runMergeCommand(args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("Usage: %s merge <PARTIAL1> [PARTIAL2 ...]", os.Args[0])
+	}
+
+	merged := make(map[string]*Measurements)
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		partial, err := ReadPartial(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		for station, m := range partial {
+			if v, ok := merged[station]; ok {
+				merged[station] = Merge(v, m)
+			} else {
+				merged[station] = m
+			}
+		}
+	}
+
+	var stations []string
+	for k := range merged {
+		stations = append(stations, k)
+	}
+	sort.Strings(stations)
+
+	output, err := writeOutput(&stations, &merged)
+	if err != nil {
+		return err
+	}
+
 	fmt.Println(output)
+	return nil
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// mmapFile maps filename into memory for read-only access and returns its
+// contents along with a close func to unmap it. Mapping once and handing
+// workers sub-slices of the result avoids opening the file per goroutine
+// and copying each worker's range into a pread buffer.
+func mmapFile(filename string) ([]byte, func() error, error) {
+	f, err := os.OpenFile(filename, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	size := fi.Size()
+	if size == 0 {
+		return []byte{}, func() error { return nil }, nil
+	}
+	if size > int64(^uint(0)>>1) {
+		return nil, nil, fmt.Errorf("File too large to map (%d bytes)", size)
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	madviseSequential(data)
+
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
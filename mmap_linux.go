@@ -0,0 +1,16 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// madviseSequential hints to the kernel that data will be read sequentially
+// and should be paged in ahead of use, which is the access pattern every
+// worker has over its range of the mapped file.
+func madviseSequential(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	syscall.Madvise(data, syscall.MADV_SEQUENTIAL)
+	syscall.Madvise(data, syscall.MADV_WILLNEED)
+}
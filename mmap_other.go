@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+// madviseSequential is a no-op outside Linux, where MADV_SEQUENTIAL /
+// MADV_WILLNEED aren't available through this code path.
+func madviseSequential(data []byte) {}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Parquet type/encoding/codec/page-type enum values, as assigned by the
+// Parquet format spec (parquet.thrift). Only the handful used by this
+// writer are named here.
+const (
+	parquetTypeInt64     int32 = 2
+	parquetTypeDouble    int32 = 5
+	parquetTypeByteArray int32 = 6
+
+	parquetRepetitionRequired int32 = 0
+
+	parquetConvertedUTF8 int32 = 0
+
+	parquetEncodingPlain int32 = 0
+	parquetEncodingRLE   int32 = 3
+
+	parquetCodecUncompressed int32 = 0
+
+	parquetPageTypeDataPage int32 = 0
+)
+
+// parquetRowGroupSize is the number of stations written per row group.
+// Chunking into row groups (rather than building one big in-memory column
+// batch for the whole station set) keeps writer memory bounded even when
+// the number of distinct stations runs into the millions.
+const parquetRowGroupSize = 50000
+
+type parquetColumnDef struct {
+	name string
+	typ  int32
+}
+
+// parquetColumns fixes the schema and column order written by
+// writeParquet: station name plus the same min/mean/max/count a 1BRC
+// result always has.
+var parquetColumns = []parquetColumnDef{
+	{"station", parquetTypeByteArray},
+	{"min", parquetTypeDouble},
+	{"mean", parquetTypeDouble},
+	{"max", parquetTypeDouble},
+	{"count", parquetTypeInt64},
+}
+
+type parquetColumnMeta struct {
+	def              parquetColumnDef
+	dataPageOffset   int64
+	numValues        int64
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+type parquetRowGroupMeta struct {
+	numRows       int64
+	totalByteSize int64
+	columns       []parquetColumnMeta
+}
+
+type countingWriter struct {
+	w      io.Writer
+	offset int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.offset += int64(n)
+	return n, err
+}
+
+// writeParquet writes stations/readings out as a Parquet file: a PAR1
+// magic header, one row group per parquetRowGroupSize stations (each
+// column written as a single uncompressed PLAIN-encoded data page), and a
+// Thrift compact-protocol footer describing the schema and row groups.
+//
+// The station column uses PLAIN rather than dictionary encoding: the
+// table already holds one row per distinct station, so every value in
+// that column is unique and a dictionary would only add a layer of
+// indirection with no repeats to compress away.
+func writeParquet(w io.Writer, stations []string, readings map[string]*Measurements) error {
+	cw := &countingWriter{w: w}
+	if _, err := cw.Write([]byte("PAR1")); err != nil {
+		return err
+	}
+
+	var rowGroups []parquetRowGroupMeta
+	for i := 0; i < len(stations); i += parquetRowGroupSize {
+		end := i + parquetRowGroupSize
+		if end > len(stations) {
+			end = len(stations)
+		}
+		rg, err := writeParquetRowGroup(cw, stations[i:end], readings)
+		if err != nil {
+			return err
+		}
+		rowGroups = append(rowGroups, rg)
+	}
+	if len(rowGroups) == 0 {
+		rg, err := writeParquetRowGroup(cw, nil, readings)
+		if err != nil {
+			return err
+		}
+		rowGroups = append(rowGroups, rg)
+	}
+
+	footer := buildParquetFooter(rowGroups, int64(len(stations)))
+	if _, err := cw.Write(footer); err != nil {
+		return err
+	}
+
+	var lenBuf [4]byte
+	binary.LittleEndian.PutUint32(lenBuf[:], uint32(len(footer)))
+	if _, err := cw.Write(lenBuf[:]); err != nil {
+		return err
+	}
+
+	_, err := cw.Write([]byte("PAR1"))
+	return err
+}
+
+// writeParquetRowGroup writes one row group's worth of column chunks
+// (station, min, mean, max, count, in that order) for the given batch of
+// stations.
+func writeParquetRowGroup(cw *countingWriter, batch []string, readings map[string]*Measurements) (parquetRowGroupMeta, error) {
+	rg := parquetRowGroupMeta{numRows: int64(len(batch))}
+
+	stationValues := new(bytes.Buffer)
+	for _, station := range batch {
+		var lenBuf [4]byte
+		binary.LittleEndian.PutUint32(lenBuf[:], uint32(len(station)))
+		stationValues.Write(lenBuf[:])
+		stationValues.WriteString(station)
+	}
+
+	minValues := new(bytes.Buffer)
+	meanValues := new(bytes.Buffer)
+	maxValues := new(bytes.Buffer)
+	countValues := new(bytes.Buffer)
+	for _, station := range batch {
+		v := readings[station]
+		binary.Write(minValues, binary.LittleEndian, float64(v.Min)/10.0)
+		binary.Write(meanValues, binary.LittleEndian, float64(v.Sum)/10.0/float64(v.Count))
+		binary.Write(maxValues, binary.LittleEndian, float64(v.Max)/10.0)
+		binary.Write(countValues, binary.LittleEndian, v.Count)
+	}
+
+	buffers := []*bytes.Buffer{stationValues, minValues, meanValues, maxValues, countValues}
+	for i, def := range parquetColumns {
+		col, err := writeParquetColumn(cw, def, buffers[i].Bytes(), len(batch))
+		if err != nil {
+			return parquetRowGroupMeta{}, err
+		}
+		rg.columns = append(rg.columns, col)
+		rg.totalByteSize += col.compressedSize
+	}
+
+	return rg, nil
+}
+
+// writeParquetColumn writes a page header followed by the already-encoded
+// PLAIN column values, returning the metadata needed to describe it in
+// the footer.
+func writeParquetColumn(cw *countingWriter, def parquetColumnDef, data []byte, numValues int) (parquetColumnMeta, error) {
+	offset := cw.offset
+
+	header := buildParquetPageHeader(numValues, len(data))
+	if _, err := cw.Write(header); err != nil {
+		return parquetColumnMeta{}, err
+	}
+	if _, err := cw.Write(data); err != nil {
+		return parquetColumnMeta{}, err
+	}
+
+	size := int64(len(header) + len(data))
+	return parquetColumnMeta{
+		def:              def,
+		dataPageOffset:   offset,
+		numValues:        int64(numValues),
+		uncompressedSize: size,
+		compressedSize:   size,
+	}, nil
+}
+
+func buildParquetPageHeader(numValues int, dataSize int) []byte {
+	tw := newThriftWriter()
+	tw.i32Field(1, parquetPageTypeDataPage)
+	tw.i32Field(2, int32(dataSize))
+	tw.i32Field(3, int32(dataSize))
+	tw.structField(5, func() {
+		tw.i32Field(1, int32(numValues))
+		tw.i32Field(2, parquetEncodingPlain)
+		tw.i32Field(3, parquetEncodingRLE)
+		tw.i32Field(4, parquetEncodingRLE)
+	})
+	return tw.finish()
+}
+
+func buildParquetFooter(rowGroups []parquetRowGroupMeta, numRows int64) []byte {
+	tw := newThriftWriter()
+
+	tw.i32Field(1, 1) // version
+
+	tw.listField(2, thriftCompactStruct, len(parquetColumns)+1, func(elem func(func())) {
+		elem(func() {
+			tw.stringField(4, "schema")
+			tw.i32Field(5, int32(len(parquetColumns)))
+		})
+		for _, def := range parquetColumns {
+			def := def
+			elem(func() {
+				tw.i32Field(1, def.typ)
+				tw.i32Field(3, parquetRepetitionRequired)
+				tw.stringField(4, def.name)
+				if def.typ == parquetTypeByteArray {
+					tw.i32Field(6, parquetConvertedUTF8)
+				}
+			})
+		}
+	})
+
+	tw.i64Field(3, numRows)
+
+	tw.listField(4, thriftCompactStruct, len(rowGroups), func(elem func(func())) {
+		for _, rg := range rowGroups {
+			rg := rg
+			elem(func() {
+				tw.listField(1, thriftCompactStruct, len(rg.columns), func(colElem func(func())) {
+					for _, col := range rg.columns {
+						col := col
+						colElem(func() {
+							tw.i64Field(2, col.dataPageOffset)
+							tw.structField(3, func() {
+								tw.i32Field(1, col.def.typ)
+								tw.listField(2, thriftCompactI32, 1, func(e func(func())) {
+									e(func() { tw.rawI32(parquetEncodingPlain) })
+								})
+								tw.listField(3, thriftCompactBinary, 1, func(e func(func())) {
+									e(func() { tw.rawString(col.def.name) })
+								})
+								tw.i32Field(4, parquetCodecUncompressed)
+								tw.i64Field(5, col.numValues)
+								tw.i64Field(6, col.uncompressedSize)
+								tw.i64Field(7, col.compressedSize)
+								tw.i64Field(9, col.dataPageOffset)
+							})
+						})
+					}
+				})
+				tw.i64Field(2, rg.totalByteSize)
+				tw.i64Field(3, rg.numRows)
+			})
+		}
+	})
+
+	tw.stringField(6, "onebrc")
+
+	return tw.finish()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// partialMagic/partialVersion identify the on-disk partial-aggregate
+// format written by `aggregate --out` and read by `merge`: magic, version,
+// then records of {name_len uint16, name bytes, min int32, max int32,
+// sum int64, count int64} (all little-endian, min/max/sum in tenths of a
+// degree) until EOF.
+const partialMagic = "OBRP"
+const partialVersion uint8 = 1
+
+// Merge combines two per-station aggregates into a new one.
+func Merge(a, b *Measurements) *Measurements {
+	return &Measurements{
+		Min:   min(a.Min, b.Min),
+		Max:   max(a.Max, b.Max),
+		Sum:   a.Sum + b.Sum,
+		Count: a.Count + b.Count,
+	}
+}
+
+// WritePartial writes stations/readings to w in the partial-aggregate
+// format.
+func WritePartial(w io.Writer, stations []string, readings map[string]*Measurements) error {
+	writer, err := NewPartialWriter(w)
+	if err != nil {
+		return err
+	}
+
+	for _, station := range stations {
+		if err := writer.WriteRecord(station, readings[station]); err != nil {
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
+
+// PartialWriter streams records to a partial-aggregate file one at a time,
+// for callers (like the external-merge k-way merge's staged spills) that
+// build up their output incrementally rather than from a stations/readings
+// pair held fully in memory.
+type PartialWriter struct {
+	w *bufio.Writer
+}
+
+// NewPartialWriter writes the partial-aggregate header to w and returns a
+// PartialWriter ready to accept records.
+func NewPartialWriter(w io.Writer) (*PartialWriter, error) {
+	writer := bufio.NewWriter(w)
+
+	if _, err := writer.WriteString(partialMagic); err != nil {
+		return nil, err
+	}
+	if err := writer.WriteByte(partialVersion); err != nil {
+		return nil, err
+	}
+
+	return &PartialWriter{w: writer}, nil
+}
+
+// WriteRecord appends one station's measurements to the file. Records must
+// be written in station name order to match ReadPartial/PartialReader's
+// (and the external-merge k-way merge's) expectations.
+func (p *PartialWriter) WriteRecord(station string, v *Measurements) error {
+	name := []byte(station)
+	if len(name) > math.MaxUint16 {
+		return fmt.Errorf("Station name '%s' too long (%d bytes) for partial aggregate format", station, len(name))
+	}
+
+	var lenBuf [2]byte
+	binary.LittleEndian.PutUint16(lenBuf[:], uint16(len(name)))
+	if _, err := p.w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	if _, err := p.w.Write(name); err != nil {
+		return err
+	}
+
+	var rec [24]byte
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(v.Min))
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(v.Max))
+	binary.LittleEndian.PutUint64(rec[8:16], uint64(v.Sum))
+	binary.LittleEndian.PutUint64(rec[16:24], uint64(v.Count))
+	_, err := p.w.Write(rec[:])
+	return err
+}
+
+// Flush flushes any buffered records to the underlying writer.
+func (p *PartialWriter) Flush() error {
+	return p.w.Flush()
+}
+
+// PartialReader streams the records of a partial-aggregate file one at a
+// time, for callers (like the external-merge k-way merge) that can't afford
+// to hold the whole file's readings in memory at once.
+type PartialReader struct {
+	r *bufio.Reader
+}
+
+// NewPartialReader validates r's header and returns a PartialReader
+// positioned at the first record.
+func NewPartialReader(r io.Reader) (*PartialReader, error) {
+	reader := bufio.NewReader(r)
+
+	magic := make([]byte, len(partialMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != partialMagic {
+		return nil, fmt.Errorf("Not a partial aggregate file (bad magic %q)", magic)
+	}
+
+	version, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != partialVersion {
+		return nil, fmt.Errorf("Unsupported partial aggregate version %d (expected %d)", version, partialVersion)
+	}
+
+	return &PartialReader{r: reader}, nil
+}
+
+// Next returns the next station/measurements record, or io.EOF once the
+// file is exhausted.
+func (p *PartialReader) Next() (string, *Measurements, error) {
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(p.r, lenBuf[:]); err != nil {
+		return "", nil, err
+	}
+	nameLen := binary.LittleEndian.Uint16(lenBuf[:])
+
+	name := make([]byte, nameLen)
+	if _, err := io.ReadFull(p.r, name); err != nil {
+		return "", nil, err
+	}
+
+	var rec [24]byte
+	if _, err := io.ReadFull(p.r, rec[:]); err != nil {
+		return "", nil, err
+	}
+
+	m := &Measurements{
+		Min:   int32(binary.LittleEndian.Uint32(rec[0:4])),
+		Max:   int32(binary.LittleEndian.Uint32(rec[4:8])),
+		Sum:   int64(binary.LittleEndian.Uint64(rec[8:16])),
+		Count: int64(binary.LittleEndian.Uint64(rec[16:24])),
+	}
+	return string(name), m, nil
+}
+
+// ReadPartial reads a whole partial-aggregate file written by WritePartial.
+func ReadPartial(r io.Reader) (map[string]*Measurements, error) {
+	reader, err := NewPartialReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	readings := make(map[string]*Measurements)
+	for {
+		name, m, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		readings[name] = m
+	}
+
+	return readings, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import "bytes"
+
+// Parquet file footers (and page headers) are serialised as Thrift using
+// the compact protocol. This is a minimal, hand-rolled compact-protocol
+// struct writer covering just the field types parquet.go needs (i32, i64,
+// double, binary, struct, list) rather than pulling in a full Thrift
+// library for a handful of fixed schemas.
+
+const (
+	thriftCompactStop   = 0x00
+	thriftCompactI32    = 0x05
+	thriftCompactI64    = 0x06
+	thriftCompactDouble = 0x07
+	thriftCompactBinary = 0x08
+	thriftCompactList   = 0x09
+	thriftCompactStruct = 0x0C
+)
+
+type thriftWriter struct {
+	buf          bytes.Buffer
+	lastFieldIDs []int16
+}
+
+func newThriftWriter() *thriftWriter {
+	w := &thriftWriter{}
+	w.lastFieldIDs = append(w.lastFieldIDs, 0)
+	return w
+}
+
+func (w *thriftWriter) bytes() []byte {
+	return w.buf.Bytes()
+}
+
+func (w *thriftWriter) writeVarint(v uint64) {
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			b |= 0x80
+		}
+		w.buf.WriteByte(b)
+		if v == 0 {
+			return
+		}
+	}
+}
+
+func thriftZigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+// writeFieldHeader writes a compact-protocol field header, using the
+// short delta form when possible, and updates the enclosing struct's last
+// field id.
+func (w *thriftWriter) writeFieldHeader(id int16, typ byte) {
+	top := len(w.lastFieldIDs) - 1
+	delta := id - w.lastFieldIDs[top]
+	if delta > 0 && delta <= 15 {
+		w.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		w.buf.WriteByte(typ)
+		w.writeVarint(thriftZigzag(int64(id)))
+	}
+	w.lastFieldIDs[top] = id
+}
+
+func (w *thriftWriter) i32Field(id int16, v int32) {
+	w.writeFieldHeader(id, thriftCompactI32)
+	w.writeVarint(thriftZigzag(int64(v)))
+}
+
+func (w *thriftWriter) i64Field(id int16, v int64) {
+	w.writeFieldHeader(id, thriftCompactI64)
+	w.writeVarint(thriftZigzag(v))
+}
+
+func (w *thriftWriter) stringField(id int16, s string) {
+	w.writeFieldHeader(id, thriftCompactBinary)
+	w.writeVarint(uint64(len(s)))
+	w.buf.WriteString(s)
+}
+
+// structField writes a nested struct field, pushing a fresh "last field
+// id" tracker for the duration of write.
+func (w *thriftWriter) structField(id int16, write func()) {
+	w.writeFieldHeader(id, thriftCompactStruct)
+	w.lastFieldIDs = append(w.lastFieldIDs, 0)
+	write()
+	w.buf.WriteByte(thriftCompactStop)
+	w.lastFieldIDs = w.lastFieldIDs[:len(w.lastFieldIDs)-1]
+}
+
+// listField writes a list of n elements of the given compact element type;
+// write is responsible for emitting each element's bytes in order (with
+// its own struct framing, if elemType is thriftCompactStruct).
+func (w *thriftWriter) listField(id int16, elemType byte, n int, write func(elem func(write func()))) {
+	w.writeFieldHeader(id, thriftCompactList)
+	if n < 15 {
+		w.buf.WriteByte(byte(n<<4) | elemType)
+	} else {
+		w.buf.WriteByte(0xF0 | elemType)
+		w.writeVarint(uint64(n))
+	}
+
+	elem := func(writeElem func()) {
+		if elemType != thriftCompactStruct {
+			writeElem()
+			return
+		}
+		w.lastFieldIDs = append(w.lastFieldIDs, 0)
+		writeElem()
+		w.buf.WriteByte(thriftCompactStop)
+		w.lastFieldIDs = w.lastFieldIDs[:len(w.lastFieldIDs)-1]
+	}
+	write(elem)
+}
+
+// rawI32 and rawString write a bare value with no field header, for use
+// inside listField's element callback where list elements aren't framed
+// as fields.
+func (w *thriftWriter) rawI32(v int32) {
+	w.writeVarint(thriftZigzag(int64(v)))
+}
+
+func (w *thriftWriter) rawString(s string) {
+	w.writeVarint(uint64(len(s)))
+	w.buf.WriteString(s)
+}
+
+// finish terminates the top-level struct being written.
+func (w *thriftWriter) finish() []byte {
+	w.buf.WriteByte(thriftCompactStop)
+	return w.buf.Bytes()
+}